@@ -1,10 +1,16 @@
 package go_socks5
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/anacrolix/missinggo"
+	"golang.org/x/time/rate"
+	"log"
 	"net"
+	"strconv"
+	"time"
 )
 
 const MaxProtoSize = 262
@@ -15,95 +21,189 @@ type Client struct {
 	Password string
 	PublicIP net.IP
 	Debug    bool
+	// TLSConfig enables TLS on the connection to the proxy when set, the server
+	// name defaults to the host of Addr. UDP datagrams are still sent in clear.
+	TLSConfig *tls.Config
+	// TLSPinnedKeys are SHA-256 hashes of the SubjectPublicKeyInfo of certificates
+	// the proxy must present one of, checked in addition to TLSConfig verification.
+	// Pins match the certificates of a verified chain, or only the leaf when
+	// InsecureSkipVerify is set. Pins enable TLS even when TLSConfig is nil, the
+	// proxy certificate is then verified against the system roots.
+	TLSPinnedKeys [][]byte
+	// WebSocketURL makes the client reach the proxy through a ws:// or wss://
+	// tunnel instead of connecting to Addr. TLSConfig and TLSPinnedKeys then
+	// apply to wss, the server name defaults to the host of the URL.
+	WebSocketURL string
+	// UDPMode selects how datagrams reach the proxy, UDPOverTCP is always used
+	// through a WebSocket tunnel.
+	UDPMode UDPMode
+	// UDPFallbackTimeout overrides DefaultUDPFallbackTimeout in UDPAuto mode.
+	UDPFallbackTimeout time.Duration
+	// ReadLimiter and WriteLimiter shape the data relayed by all the connections
+	// of the client, one token per byte.
+	ReadLimiter  *rate.Limiter
+	WriteLimiter *rate.Limiter
+	// ConnRateLimit limits each connection to this many bytes per second in
+	// each direction, unlimited when zero.
+	ConnRateLimit int
 }
 
-func (c *Client) connect() (*Connection, error) {
-	controlconn, err := net.Dial("tcp", c.Addr)
+func (c *Client) connect(ctx context.Context) (*Connection, error) {
+	controlconn, err := c.dialProxy(ctx)
 	if err != nil {
-		return nil, err
-	}
-	conn := &Connection{
-		client: c,
-		conn:   controlconn,
-	}
-	if c.Username == "" && c.Password == "" {
-		return conn, nil
+		return nil, errors.New("can't connect to socks5 server: " + err.Error())
 	}
+	conn := newConnection(c, controlconn)
 
+	stop := conn.watch(ctx)
 	err = conn.authenticate()
+	stop()
 	if err != nil {
 		defer controlconn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
 
 	return conn, nil
 }
 
-func (c *Client) dialTCP(network, address string) (*TCPConnection, error) {
-	controlconn, err := net.Dial("tcp", c.Addr)
+func (c *Client) dialTCP(ctx context.Context, network, address string) (*TCPConnection, error) {
+	remoteAddr, err := proxyAddr(network, address)
 	if err != nil {
-		return nil, errors.New("can't connect to socks5 server: " + err.Error())
-	}
-	connection := &Connection{
-		conn:   controlconn,
-		client: c,
-	}
-	if err := connection.authenticate(); err != nil {
 		return nil, err
 	}
-	//TODO resolve using socks5
-	tcpAddr, err := net.ResolveTCPAddr(network, address)
+
+	connection, err := c.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
-	localAddr, err := connection.connect(tcpAddr.String())
+
+	stop := connection.watch(ctx)
+	localAddr, err := connection.connect(address)
+	stop()
 	if err != nil {
+		defer connection.close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
 	return &TCPConnection{
 		debug:      c.Debug,
 		localAddr:  localAddr,
-		remoteAddr: tcpAddr,
-		forward:    controlconn,
+		remoteAddr: remoteAddr,
+		forward:    connection.conn,
+		reader:     connection.reader,
+		shaper:     c.newShaper(),
 	}, nil
 }
 
-func (c *Client) dialUDP(network, address string) (*UDPConnection, error) {
-	connection, err := c.connect()
+func (c *Client) dialUDP(ctx context.Context, network, address string) (*UDPConnection, error) {
+	remoteAddr, err := proxyAddr(network, address)
 	if err != nil {
 		return nil, err
 	}
 
-	//TODO resolve using proxy
-	remoteAddr, err := net.ResolveUDPAddr(network, address)
+	conn, err := c.udpConnection(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
+	conn.remoteAddr = remoteAddr
+	return conn, nil
+}
 
-	relayAddr, err := connection.udpAssociate(nil)
-	if err != nil {
-		return nil, err
+func (c *Client) udpConnection(ctx context.Context, laddr *net.UDPAddr) (*UDPConnection, error) {
+	mode := c.UDPMode
+	if c.WebSocketURL != "" {
+		// the relay port is out of reach through a websocket
+		mode = UDPOverTCP
 	}
 
-	f, err := net.DialUDP(relayAddr.Network(), nil, relayAddr)
+	var connection *Connection
+	var forward datagramConn
+	var err error
+	if mode != UDPOverTCP {
+		connection, forward, err = c.udpRelay(ctx, laddr)
+	}
+	if mode == UDPOverTCP || (mode == UDPAuto && err != nil && ctx.Err() == nil) {
+		if err != nil && c.Debug {
+			log.Println("udp associate failed, falling back to udp tunnel:", err)
+		}
+		connection, forward, err = c.udpTunnel(ctx, laddr)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	return &UDPConnection{
-		forward:     f,
+		client:      c,
+		laddr:       laddr,
 		controlconn: connection,
+		forward:     forward,
 		debug:       c.Debug,
-		remoteAddr:  remoteAddr,
+		shaper:      c.newShaper(),
+		fallback:    mode == UDPAuto && isRelay(forward),
 	}, nil
 }
 
+func (c *Client) udpRelay(ctx context.Context, laddr *net.UDPAddr) (*Connection, datagramConn, error) {
+	connection, err := c.connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stop := connection.watch(ctx)
+	relayAddr, err := connection.udpAssociate(laddr)
+	stop()
+	if err != nil {
+		connection.close()
+		return nil, nil, err
+	}
+	if relayAddr.IP == nil || relayAddr.IP.IsUnspecified() {
+		// the relay listens on the proxy host
+		if tcpAddr, ok := connection.conn.RemoteAddr().(*net.TCPAddr); ok {
+			relayAddr.IP = tcpAddr.IP
+		}
+	}
+
+	f, err := net.DialUDP(relayAddr.Network(), laddr, relayAddr)
+	if err != nil {
+		connection.close()
+		return nil, nil, err
+	}
+	return connection, relayConn{f}, nil
+}
+
+func (c *Client) udpTunnel(ctx context.Context, laddr *net.UDPAddr) (*Connection, datagramConn, error) {
+	connection, err := c.connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stop := connection.watch(ctx)
+	_, err = connection.udpTunnel(laddr)
+	stop()
+	if err != nil {
+		connection.close()
+		return nil, nil, err
+	}
+	return connection, &tunnelConn{Connection: connection}, nil
+}
+
 func (c *Client) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address through the proxy, ctx bounds both the
+// connection to the proxy and the SOCKS handshake.
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	switch network {
 	case "udp", "udp4", "udp6":
-		return c.dialUDP(network, address)
+		return c.dialUDP(ctx, network, address)
 	case "tcp", "tcp4", "tcp6":
-		return c.dialTCP(network, address)
+		return c.dialTCP(ctx, network, address)
 	default:
 		return nil, errors.New("unsupported network")
 	}
@@ -119,7 +219,7 @@ func (c *Client) DialTCP(network string, laddr, raddr *net.TCPAddr) (*TCPConnect
 	if raddr == nil {
 		return nil, errors.New("missing remote address")
 	}
-	return c.dialTCP(network, raddr.String())
+	return c.dialTCP(context.Background(), network, raddr.String())
 }
 
 func (c *Client) DialUDP(network string, laddr, raddr *net.UDPAddr) (*UDPConnection, error) {
@@ -132,7 +232,7 @@ func (c *Client) DialUDP(network string, laddr, raddr *net.UDPAddr) (*UDPConnect
 	if raddr == nil {
 		return nil, errors.New("missing remote address")
 	}
-	return c.dialUDP(network, raddr.String())
+	return c.dialUDP(context.Background(), network, raddr.String())
 }
 
 func (c *Client) Listen(network, address string) (net.Listener, error) {
@@ -143,6 +243,10 @@ func (c *Client) Listen(network, address string) (net.Listener, error) {
 	return c.ListenTCP(network, tcpAddr)
 }
 
+// ListenTCP returns a listener for connections made to a port of the proxy with
+// BIND, laddr is sent as the address of the expected peer. A BIND request only
+// serves one connection, the listener issues a new one after each Accept so
+// Addr may change from one connection to the next.
 func (c *Client) ListenTCP(network string, laddr *net.TCPAddr) (net.Listener, error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
@@ -151,16 +255,9 @@ func (c *Client) ListenTCP(network string, laddr *net.TCPAddr) (net.Listener, er
 		return nil, errors.New(fmt.Sprintf("wrong network type: %s", network))
 	}
 
-	l, err := net.ListenTCP(network, laddr)
-	if err != nil {
-		return nil, errors.New("can't listen" + err.Error())
-	}
-
-	connection, err := c.connect()
-	if err != nil {
-		return nil, errors.New("can't connect to socks5 server: " + err.Error())
+	if laddr == nil {
+		laddr = &net.TCPAddr{}
 	}
-
 	addr := laddr
 	if c.PublicIP != nil {
 		addr = &net.TCPAddr{
@@ -168,20 +265,28 @@ func (c *Client) ListenTCP(network string, laddr *net.TCPAddr) (net.Listener, er
 			Port: addr.Port,
 		}
 	}
-	bindAddr, err := connection.bind(addr)
-	if err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &TCPListener{
+		client: c,
+		laddr:  addr,
+		debug:  c.Debug,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if err := l.bind(); err != nil {
+		cancel()
 		return nil, err
 	}
-
-	return &TCPListener{
-		controlconn:    connection.conn,
-		remoteBindAddr: bindAddr,
-		debug:          c.Debug,
-		localListener:  l,
-	}, nil
+	return l, nil
 }
 
 func (c *Client) ListenPacket(network string, address string) (net.PacketConn, error) {
+	return c.ListenPacketContext(context.Background(), network, address)
+}
+
+// ListenPacketContext opens a UDP association, ctx bounds both the connection
+// to the proxy and the SOCKS handshake.
+func (c *Client) ListenPacketContext(ctx context.Context, network string, address string) (net.PacketConn, error) {
 	host, port, err := missinggo.ParseHostPort(address)
 	if err != nil {
 		return nil, err
@@ -190,10 +295,14 @@ func (c *Client) ListenPacket(network string, address string) (net.PacketConn, e
 		IP:   net.ParseIP(host),
 		Port: port,
 	}
-	return c.ListenUDP(network, addr)
+	return c.listenUDP(ctx, network, addr)
 }
 
 func (c *Client) ListenUDP(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	return c.listenUDP(context.Background(), network, laddr)
+}
+
+func (c *Client) listenUDP(ctx context.Context, network string, laddr *net.UDPAddr) (net.PacketConn, error) {
 	switch network {
 	case "udp", "udp4", "udp6":
 		break
@@ -201,37 +310,42 @@ func (c *Client) ListenUDP(network string, laddr *net.UDPAddr) (net.PacketConn,
 		return nil, errors.New(fmt.Sprintf("wrong network type: %s", network))
 	}
 
-	conn, err := net.Dial("tcp", c.Addr)
-	if err != nil {
-		return nil, errors.New("can't connect to socks5 server: " + err.Error())
-	}
-
-	if laddr == nil {
-		t := conn.LocalAddr().(*net.TCPAddr)
-		laddr = &net.UDPAddr{
-			IP:   t.IP,
-			Port: 0,
-		}
-	}
+	return c.udpConnection(ctx, laddr)
+}
 
-	connection, err := c.connect()
+// proxyAddr returns address as a net.Addr without resolving it, hostnames are
+// sent as is so the proxy does the resolving.
+func proxyAddr(network, address string) (net.Addr, error) {
+	host, portStr, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, err
 	}
-
-	bindAddr, err := connection.udpAssociate(laddr)
-	if err != nil {
-		return nil, err
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &domainAddr{network: network, address: address}, nil
 	}
-
-	f, err := net.ListenUDP(bindAddr.Network(), laddr)
+	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		return nil, err
+		return nil, errors.New("proxy: failed to parse port number: " + portStr)
+	}
+	switch network {
+	case "udp", "udp4", "udp6":
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	default:
+		return &net.TCPAddr{IP: ip, Port: port}, nil
 	}
+}
 
-	return &UDPConnection{
-		controlconn: connection,
-		debug:       c.Debug,
-		forward:     f,
-	}, nil
+// domainAddr is a destination address left for the proxy to resolve.
+type domainAddr struct {
+	network string
+	address string
+}
+
+func (a *domainAddr) Network() string {
+	return a.network
+}
+
+func (a *domainAddr) String() string {
+	return a.address
 }
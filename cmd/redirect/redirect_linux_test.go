@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/nicdex/go-socks5"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The integration test runs the redirector in a network namespace behind which a
+// client namespace sends traffic to 198.51.100.1, a documentation address that
+// only netfilter rules lead anywhere. It needs root, ip and iptables.
+//
+//	client ns 10.200.0.2 --veth-- 10.200.0.1 redirector ns, fake proxy on 127.0.0.1
+const (
+	redirectPort = 12345
+	tproxyPort   = 12346
+	target       = "198.51.100.1"
+)
+
+func TestRedirect(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to set up network namespaces")
+	}
+	for _, cmd := range []string{"ip", "iptables"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skip(cmd, "not found")
+		}
+	}
+
+	router := fmt.Sprintf("redirect-test-%d", os.Getpid())
+	client := router + "-client"
+	run(t, "ip", "netns", "add", router)
+	t.Cleanup(func() { exec.Command("ip", "netns", "del", router).Run() })
+	run(t, "ip", "netns", "add", client)
+	t.Cleanup(func() { exec.Command("ip", "netns", "del", client).Run() })
+
+	run(t, "ip", "-n", router, "link", "add", "veth0", "type", "veth", "peer", "name", "veth0", "netns", client)
+	run(t, "ip", "-n", router, "addr", "add", "10.200.0.1/24", "dev", "veth0")
+	run(t, "ip", "-n", router, "link", "set", "veth0", "up")
+	run(t, "ip", "-n", router, "link", "set", "lo", "up")
+	run(t, "ip", "-n", client, "addr", "add", "10.200.0.2/24", "dev", "veth0")
+	run(t, "ip", "-n", client, "link", "set", "veth0", "up")
+	run(t, "ip", "-n", client, "link", "set", "lo", "up")
+	run(t, "ip", "-n", client, "route", "add", "default", "via", "10.200.0.1")
+
+	// TPROXY marks the packets it diverts, they are delivered locally
+	run(t, "ip", "-n", router, "rule", "add", "fwmark", "1", "lookup", "100")
+	run(t, "ip", "-n", router, "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", "100")
+	iptables := []string{"ip", "netns", "exec", router, "iptables"}
+	run(t, append(iptables, "-t", "nat", "-A", "PREROUTING", "-i", "veth0", "-p", "tcp", "--dport", "80",
+		"-j", "REDIRECT", "--to-ports", strconv.Itoa(redirectPort))...)
+	run(t, append(iptables, "-t", "mangle", "-A", "PREROUTING", "-i", "veth0", "-p", "tcp", "--dport", "81",
+		"-j", "TPROXY", "--on-port", strconv.Itoa(tproxyPort), "--tproxy-mark", "1")...)
+	run(t, append(iptables, "-t", "mangle", "-A", "PREROUTING", "-i", "veth0", "-p", "udp", "--dport", "53",
+		"-j", "TPROXY", "--on-port", strconv.Itoa(tproxyPort), "--tproxy-mark", "1")...)
+
+	// handleTCP reads the mode from its flag, each mode gets its own redirector
+	startHelper(t, router, "redirect")
+	startHelper(t, router, "tproxy")
+
+	t.Run("redirect tcp", func(t *testing.T) {
+		testTCP(t, client, net.JoinHostPort(target, "80"))
+	})
+	t.Run("tproxy tcp", func(t *testing.T) {
+		testTCP(t, client, net.JoinHostPort(target, "81"))
+	})
+	t.Run("tproxy udp", func(t *testing.T) {
+		var conn net.Conn
+		var err error
+		inNetns(t, client, func() {
+			conn, err = net.Dial("udp", net.JoinHostPort(target, "53"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// answers come from the original destination, a connected socket
+		// drops any other
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("query")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "query" {
+			t.Fatalf("got %q", buf[:n])
+		}
+	})
+}
+
+func testTCP(t *testing.T, ns, address string) {
+	var conn net.Conn
+	var err error
+	inNetns(t, ns, func() {
+		conn, err = net.DialTimeout("tcp", address, 5*time.Second)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	// the fake proxy first tells where it was asked to connect
+	dst, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst != address+"\n" {
+		t.Fatalf("proxy connected to %q, want %s", strings.TrimSpace(dst), address)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("got %q", buf)
+	}
+}
+
+func run(t *testing.T, args ...string) {
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		t.Fatalf("%s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+// inNetns runs f on a thread moved to the network namespace ns, the sockets f
+// opens stay in it.
+func inNetns(t *testing.T, ns string, f func()) {
+	runtime.LockOSThread()
+	orig, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatal(err)
+	}
+	defer orig.Close()
+	nsFile, err := os.Open("/var/run/netns/" + ns)
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatal(err)
+	}
+	defer nsFile.Close()
+	if err := unix.Setns(int(nsFile.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		t.Fatal(err)
+	}
+	f()
+	if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+		// the thread is left locked, it exits with the goroutine
+		t.Fatal(err)
+	}
+	runtime.UnlockOSThread()
+}
+
+// startHelper runs a redirector in the namespace ns from TestRedirectHelper, in a
+// process of its own so every socket it opens lands in the namespace.
+func startHelper(t *testing.T, ns, mode string) {
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestRedirectHelper$")
+	cmd.Env = append(os.Environ(), "REDIRECT_TEST_HELPER="+mode)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "ready\n" {
+		t.Fatalf("helper for %s didn't start: %q %v", mode, line, err)
+	}
+}
+
+func TestRedirectHelper(t *testing.T) {
+	helperMode := os.Getenv("REDIRECT_TEST_HELPER")
+	if helperMode == "" {
+		t.Skip("run by TestRedirect")
+	}
+	*mode = helperMode
+
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveFakeProxy(proxy)
+	client := &go_socks5.Client{Addr: proxy.Addr().String()}
+
+	if *mode == "redirect" {
+		l, err := listenTCP(":"+strconv.Itoa(redirectPort), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveTCP(l, client)
+	} else {
+		l, err := listenTCP(":"+strconv.Itoa(tproxyPort), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveTCP(l, client)
+		conn, err := listenUDP(":" + strconv.Itoa(tproxyPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveUDP(conn, client)
+	}
+	fmt.Println("ready")
+	select {}
+}
+
+// serveFakeProxy is a socks5 server without authentication that doesn't reach
+// out: CONNECT sends the requested address and a newline then echoes, the relay
+// of UDP ASSOCIATE echoes each datagram as coming from its destination.
+func serveFakeProxy(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			cmd, dst, err := readFakeRequest(conn)
+			if err != nil {
+				return
+			}
+			switch cmd {
+			case 1:
+				conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+				fmt.Fprintln(conn, dst)
+				io.Copy(conn, conn)
+			case 3:
+				relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					return
+				}
+				defer relay.Close()
+				port := relay.LocalAddr().(*net.UDPAddr).Port
+				conn.Write(binary.BigEndian.AppendUint16([]byte{5, 0, 0, 1, 127, 0, 0, 1}, uint16(port)))
+				go func() {
+					buf := make([]byte, 64*1024)
+					for {
+						n, from, err := relay.ReadFromUDP(buf)
+						if err != nil {
+							return
+						}
+						relay.WriteToUDP(buf[:n], from)
+					}
+				}()
+				io.Copy(io.Discard, conn)
+			default:
+				conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+			}
+		}()
+	}
+}
+
+func readFakeRequest(conn net.Conn) (byte, string, error) {
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return 0, "", err
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return 0, "", err
+	}
+	conn.Write([]byte{5, 0})
+
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return 0, "", err
+	}
+	cmd := buf[1]
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:net.IPv4len]); err != nil {
+			return 0, "", err
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return 0, "", err
+		}
+		name := buf[1 : 1+buf[0]]
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return 0, "", err
+		}
+		host = string(name)
+	case 4:
+		if _, err := io.ReadFull(conn, buf[:net.IPv6len]); err != nil {
+			return 0, "", err
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return 0, "", err
+	}
+	return cmd, net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2])))), nil
+}
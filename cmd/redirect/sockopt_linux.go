@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+const ip6tSoOriginalDst = 80
+
+// originalDst returns the destination of a connection before it was redirected by netfilter.
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// sockaddr_in6 fits in the ip6_mtuinfo the call expects
+			info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			// the port is kept in network byte order
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, info.Addr.Addr[:])
+			addr = &net.TCPAddr{
+				IP:   ip,
+				Port: int(binary.BigEndian.Uint16(port[:])),
+			}
+			return
+		}
+		// sockaddr_in fits in the ipv6_mreq the call expects
+		mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+			Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+// transparent sets IP_TRANSPARENT so the socket can accept traffic for, or
+// send from, addresses that aren't local.
+func transparent(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); sockErr != nil {
+			return
+		}
+		if network == "tcp6" || network == "udp6" {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func listenTCP(address string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = transparent
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// listenUDP listens for datagrams delivered by TPROXY, their original destination
+// is received along with them.
+func listenUDP(address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := transparent(network, address, c); err != nil {
+				return err
+			}
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); sockErr != nil {
+					return
+				}
+				if network == "udp6" {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// udpOriginalDst extracts the original destination from the control messages of a datagram.
+func udpOriginalDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR && len(msg.Data) >= unix.SizeofSockaddrInet4:
+			// struct sockaddr_in
+			return &net.UDPAddr{
+				IP:   net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7]),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR && len(msg.Data) >= unix.SizeofSockaddrInet6:
+			// struct sockaddr_in6
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, msg.Data[8:24])
+			return &net.UDPAddr{
+				IP:   ip,
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		}
+	}
+	return nil, errors.New("no original destination in control messages")
+}
+
+// dialTransparentUDP opens a socket sending datagrams to dst from the non local address src.
+func dialTransparentUDP(src, dst *net.UDPAddr) (net.Conn, error) {
+	d := net.Dialer{
+		LocalAddr: src,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := transparent(network, address, c); err != nil {
+				return err
+			}
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return d.Dial("udp", dst.String())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"net"
+	"testing"
+	"unsafe"
+)
+
+// cmsg builds a control message as the kernel lays it out.
+func cmsg(level, typ int, data []byte) []byte {
+	b := make([]byte, unix.CmsgSpace(len(data)))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(unix.CmsgLen(len(data)))
+	copy(b[unix.CmsgLen(0):], data)
+	return b
+}
+
+// sockaddrInet4 is a struct sockaddr_in, the port in network byte order.
+func sockaddrInet4(ip net.IP, port int) []byte {
+	b := make([]byte, unix.SizeofSockaddrInet4)
+	*(*uint16)(unsafe.Pointer(&b[0])) = unix.AF_INET
+	binary.BigEndian.PutUint16(b[2:], uint16(port))
+	copy(b[4:], ip.To4())
+	return b
+}
+
+// sockaddrInet6 is a struct sockaddr_in6, the port in network byte order.
+func sockaddrInet6(ip net.IP, port int) []byte {
+	b := make([]byte, unix.SizeofSockaddrInet6)
+	*(*uint16)(unsafe.Pointer(&b[0])) = unix.AF_INET6
+	binary.BigEndian.PutUint16(b[2:], uint16(port))
+	binary.BigEndian.PutUint32(b[4:], 0x12345) // flow info, skipped
+	copy(b[8:], ip.To16())
+	return b
+}
+
+func TestUDPOriginalDst(t *testing.T) {
+	// a struct timeval on 64-bit
+	timestamp := cmsg(unix.SOL_SOCKET, unix.SO_TIMESTAMP, make([]byte, 16))
+	tests := []struct {
+		name string
+		oob  []byte
+		want string
+	}{
+		{
+			name: "ipv4",
+			oob:  cmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, sockaddrInet4(net.IPv4(198, 51, 100, 1), 53)),
+			want: "198.51.100.1:53",
+		},
+		{
+			name: "ipv6",
+			oob:  cmsg(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR, sockaddrInet6(net.ParseIP("2001:db8::1"), 5353)),
+			want: "[2001:db8::1]:5353",
+		},
+		{
+			name: "after another message",
+			oob:  append(timestamp, cmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, sockaddrInet4(net.IPv4(192, 0, 2, 7), 65535))...),
+			want: "192.0.2.7:65535",
+		},
+		{
+			name: "none",
+			oob:  timestamp,
+		},
+		{
+			name: "short",
+			oob:  cmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, sockaddrInet4(net.IPv4(198, 51, 100, 1), 53)[:8]),
+		},
+		{
+			name: "ipv6 level with an ipv4 address",
+			oob:  cmsg(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR, sockaddrInet4(net.IPv4(198, 51, 100, 1), 53)),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, err := udpOriginalDst(test.oob)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("got %s, want an error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != test.want {
+				t.Fatalf("got %s, want %s", addr, test.want)
+			}
+		})
+	}
+}
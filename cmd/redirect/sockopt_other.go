@@ -0,0 +1,33 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errNotSupported = errors.New("transparent proxying is only supported on linux")
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errNotSupported
+}
+
+func listenTCP(address string, tproxy bool) (net.Listener, error) {
+	if tproxy {
+		return nil, errNotSupported
+	}
+	return net.Listen("tcp", address)
+}
+
+func listenUDP(address string) (*net.UDPConn, error) {
+	return nil, errNotSupported
+}
+
+func udpOriginalDst(oob []byte) (*net.UDPAddr, error) {
+	return nil, errNotSupported
+}
+
+func dialTransparentUDP(src, dst *net.UDPAddr) (net.Conn, error) {
+	return nil, errNotSupported
+}
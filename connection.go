@@ -1,17 +1,66 @@
 package go_socks5
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strconv"
+	"time"
 )
 
 type Connection struct {
 	client *Client
 	conn   net.Conn
+	// reader buffers the control connection so replies are consumed exactly,
+	// anything read past a reply stays available to the next reader
+	reader *bufio.Reader
+}
+
+// ReplyError is a request refused by the proxy with a non zero REP code.
+type ReplyError struct {
+	Command string
+	Code    byte
+}
+
+var replyMessages = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+	// Tor extended errors, for onion services
+	0xf0: "onion service descriptor can not be found",
+	0xf1: "onion service descriptor is invalid",
+	0xf2: "onion service introduction failed",
+	0xf3: "onion service rendezvous failed",
+	0xf4: "onion service missing client authorization",
+	0xf5: "onion service wrong client authorization",
+	0xf6: "onion service invalid address",
+	0xf7: "onion service introduction timed out",
+}
+
+func (e *ReplyError) Error() string {
+	msg, ok := replyMessages[e.Code]
+	if !ok {
+		msg = fmt.Sprintf("status=%x", e.Code)
+	}
+	return fmt.Sprintf("proxy: %s failed: %s", e.Command, msg)
+}
+
+func newConnection(client *Client, conn net.Conn) *Connection {
+	return &Connection{
+		client: client,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
 }
 
 func (c Connection) writePacket(buf []byte) error {
@@ -28,37 +77,122 @@ func (c Connection) writePacket(buf []byte) error {
 	return nil
 }
 
-func (c Connection) readPacket(buf []byte) (int, error) {
-	rc, err := c.conn.Read(buf)
-	if err != nil {
-		return rc, err
+func (c Connection) readPacket(buf []byte) error {
+	if _, err := io.ReadFull(c.reader, buf); err != nil {
+		return err
 	}
 	if c.client.Debug {
-		log.Println("R", buf[:rc])
+		log.Println("R", buf)
+	}
+	return nil
+}
+
+// readReply reads a complete request reply (VER, REP, RSV, ATYP, BND.ADDR, BND.PORT)
+// and returns the reply code along with the bound address.
+func (c Connection) readReply() (byte, *net.TCPAddr, error) {
+	rep, host, port, err := c.readReplyHost()
+	if err != nil {
+		return 0, nil, err
+	}
+	return rep, &net.TCPAddr{
+		IP:   net.ParseIP(host),
+		Port: port,
+	}, nil
+}
+
+// readReplyHost is readReply keeping BND.ADDR as a string, a hostname when the
+// proxy replied with a domain.
+func (c Connection) readReplyHost() (byte, string, int, error) {
+	buf := make([]byte, MaxProtoSize)
+	if err := c.readPacket(buf[:4]); err != nil {
+		return 0, "", 0, err
+	}
+	if buf[0] != 5 {
+		return 0, "", 0, errors.New(fmt.Sprintf("proxy: unexpected protocol version: %d", buf[0]))
+	}
+	rep := buf[1]
+
+	var addrLen int
+	switch buf[3] {
+	case 1: // IPv4
+		addrLen = net.IPv4len
+	case 3: // domain
+		if err := c.readPacket(buf[:1]); err != nil {
+			return 0, "", 0, err
+		}
+		addrLen = int(buf[0])
+	case 4: // IPv6
+		addrLen = net.IPv6len
+	default:
+		return 0, "", 0, errors.New(fmt.Sprintf("proxy: unsupported atyp: %d", buf[3]))
+	}
+	atyp := buf[3]
+	if err := c.readPacket(buf[:addrLen+2]); err != nil {
+		return 0, "", 0, err
+	}
+
+	host := string(buf[:addrLen])
+	if atyp != 3 {
+		host = net.IP(buf[:addrLen]).String()
+	}
+	return rep, host, int(binary.BigEndian.Uint16(buf[addrLen : addrLen+2])), nil
+}
+
+// watch interrupts blocking I/O on the control connection once ctx is done,
+// the returned func must be called when the exchange guarded by ctx is over.
+func (c Connection) watch(ctx context.Context) func() {
+	return watchConn(ctx, c.conn)
+}
+
+func watchConn(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		conn.SetDeadline(time.Time{})
 	}
-	return rc, nil
 }
 
 func (c Connection) authenticate() error {
-	//TODO support other method than username/password
 	buf := make([]byte, MaxProtoSize)
 	buf[0] = 5 // Socks 5
 	buf[1] = 1 // 1 Method
-	buf[2] = 2 // username/password
+	buf[2] = 0 // no authentication
+	if c.client.Username != "" || c.client.Password != "" {
+		buf[2] = 2 // username/password
+	}
 	if err := c.writePacket(buf[0:3]); err != nil {
 		return err
 	}
-	if rc, err := c.readPacket(buf); err != nil {
+	if err := c.readPacket(buf[:2]); err != nil {
 		return err
-	} else if rc != 2 {
-		return errors.New(fmt.Sprintf("proxy: unexpected response packet size: %d", rc))
 	} else if buf[1] == 0xff {
 		return errors.New("proxy: no acceptable authentication method")
+	} else if buf[1] == 0 {
+		return nil
+	} else if buf[1] != 2 {
+		return errors.New(fmt.Sprintf("proxy: unexpected authentication method: %d", buf[1]))
 	}
 
 	username_len := len(c.client.Username)
 	password_len := len(c.client.Password)
 
+	if username_len > 255 || password_len > 255 {
+		return errors.New("proxy: username or password too long")
+	}
+
 	buf[0] = 1
 	buf[1] = byte(username_len)
 	copy(buf[2:], c.client.Username)
@@ -67,10 +201,8 @@ func (c Connection) authenticate() error {
 	if err := c.writePacket(buf[0 : 3+username_len+password_len]); err != nil {
 		return err
 	}
-	if rc, err := c.readPacket(buf); err != nil {
+	if err := c.readPacket(buf[:2]); err != nil {
 		return err
-	} else if rc != 2 {
-		return errors.New(fmt.Sprintf("proxy: unexpected response packet size: %d", rc))
 	} else if buf[1] != 0 {
 		return errors.New(fmt.Sprintf("proxy: authentication failed: status=%x", buf[1]))
 	}
@@ -79,38 +211,40 @@ func (c Connection) authenticate() error {
 }
 
 func (c Connection) bind(laddr *net.TCPAddr) (*net.TCPAddr, error) {
-	buf := make([]byte, MaxProtoSize)
-	buf[0] = 5 // Ver
-	buf[1] = 2 // bind
-	buf[2] = 0 // Reserved
-	buf[3] = 1 // IPv4
-	copy(buf[4:8], laddr.IP.To4())
-	binary.BigEndian.PutUint16(buf[8:10], uint16(laddr.Port))
-	//TODO support ipv6, domain
-	if err := c.writePacket(buf[0:10]); err != nil {
+	ip := laddr.IP
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	if err := c.request(2, ip.String(), laddr.Port); err != nil {
 		return nil, err
 	}
 
-	if rc, err := c.readPacket(buf); err != nil {
+	rep, bindAddr, err := c.readReply()
+	if err != nil {
 		return nil, err
-	} else if rc != 10 {
-		return nil, errors.New(fmt.Sprintf("proxy: unexpected response packet size: %d", rc))
-	} else if buf[1] != 0 {
-		return nil, errors.New(fmt.Sprintf("proxy: udp associate failed: status=%x", buf[1]))
+	} else if rep != 0 {
+		return nil, &ReplyError{Command: "bind", Code: rep}
 	}
 
-	return &net.TCPAddr{
-		IP:   buf[4:8],
-		Port: int(binary.BigEndian.Uint16(buf[8:10])),
-	}, nil
+	return bindAddr, nil
 }
 
 func (c Connection) udpAssociate(laddr *net.UDPAddr) (*net.UDPAddr, error) {
+	return c.udpRequest(3, "udp associate")
+}
+
+// udpTunnel asks for datagrams to be carried in the control connection itself,
+// using the UDP tunnel command (0xF3) of gost and compatible servers.
+func (c Connection) udpTunnel(laddr *net.UDPAddr) (*net.UDPAddr, error) {
+	return c.udpRequest(0xf3, "udp tunnel")
+}
+
+func (c Connection) udpRequest(cmd byte, name string) (*net.UDPAddr, error) {
 	buf := make([]byte, MaxProtoSize)
-	buf[0] = 5 // Ver
-	buf[1] = 3 // UDP Associate
-	buf[2] = 0 // Reserved
-	buf[3] = 1 // IPv4
+	buf[0] = 5   // Ver
+	buf[1] = cmd // UDP Associate or UDP tunnel
+	buf[2] = 0   // Reserved
+	buf[3] = 1   // IPv4
 	//All blank if local network
 	for k := 4; k < 10; k++ {
 		buf[k] = 0
@@ -120,17 +254,16 @@ func (c Connection) udpAssociate(laddr *net.UDPAddr) (*net.UDPAddr, error) {
 		return nil, err
 	}
 
-	if rc, err := c.readPacket(buf); err != nil {
+	rep, relayAddr, err := c.readReply()
+	if err != nil {
 		return nil, err
-	} else if rc != 10 {
-		return nil, errors.New(fmt.Sprintf("proxy: unexpected response packet size: %d", rc))
-	} else if buf[1] != 0 {
-		return nil, errors.New(fmt.Sprintf("proxy: udp associate failed: status=%x", buf[1]))
+	} else if rep != 0 {
+		return nil, &ReplyError{Command: name, Code: rep}
 	}
 
 	return &net.UDPAddr{
-		IP:   buf[4:8],
-		Port: int(binary.BigEndian.Uint16(buf[8:10])),
+		IP:   relayAddr.IP,
+		Port: relayAddr.Port,
 	}, nil
 }
 
@@ -148,10 +281,26 @@ func (c Connection) connect(address string) (*net.TCPAddr, error) {
 		return nil, errors.New("proxy: port number out of range: " + portStr)
 	}
 
+	if err := c.request(1, host, port); err != nil {
+		return nil, err
+	}
+
+	rep, localAddr, err := c.readReply()
+	if err != nil {
+		return nil, err
+	} else if rep != 0 {
+		return nil, &ReplyError{Command: "connect", Code: rep}
+	}
+
+	return localAddr, nil
+}
+
+// request sends a request for cmd with host as DST.ADDR, an IP address or a hostname.
+func (c Connection) request(cmd byte, host string, port int) error {
 	buf := make([]byte, MaxProtoSize)
-	buf[0] = 5 // Ver
-	buf[1] = 1 // Connect
-	buf[2] = 0 // Reserved
+	buf[0] = 5   // Ver
+	buf[1] = cmd // Command
+	buf[2] = 0   // Reserved
 
 	size := 4
 	if ip := net.ParseIP(host); ip != nil {
@@ -165,7 +314,7 @@ func (c Connection) connect(address string) (*net.TCPAddr, error) {
 	} else {
 		host_len := len(host)
 		if host_len > 255 {
-			return nil, errors.New("proxy: hostname too long: " + host)
+			return errors.New("proxy: hostname too long: " + host)
 		}
 		buf[3] = 3 // domain
 		buf[size] = byte(host_len)
@@ -175,22 +324,7 @@ func (c Connection) connect(address string) (*net.TCPAddr, error) {
 	binary.BigEndian.PutUint16(buf[size:], uint16(port))
 	size += 2
 
-	if err := c.writePacket(buf[:size]); err != nil {
-		return nil, err
-	}
-
-	if rc, err := c.readPacket(buf); err != nil {
-		return nil, err
-	} else if rc < 10 {
-		return nil, errors.New("unexpected response")
-	} else if buf[1] != 0 {
-		return nil, errors.New(fmt.Sprintf("connect failed: %d", buf[1]))
-	}
-
-	return &net.TCPAddr{
-		IP:   buf[4:8],
-		Port: int(binary.LittleEndian.Uint16(buf[8:10])),
-	}, nil
+	return c.writePacket(buf[:size])
 }
 
 func (c *Connection) close() error {
@@ -0,0 +1,116 @@
+package go_socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func pipeConnection(t *testing.T) (*Connection, net.Conn) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return newConnection(&Client{}, client), server
+}
+
+func TestReadReplySplit(t *testing.T) {
+	connection, server := pipeConnection(t)
+	reply := []byte{5, 0, 0, 1, 10, 0, 0, 1, 0x1f, 0x90}
+	go func() {
+		for i := range reply {
+			if _, err := server.Write(reply[i : i+1]); err != nil {
+				return
+			}
+		}
+	}()
+
+	rep, addr, err := connection.readReply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep != 0 || addr.String() != "10.0.0.1:8080" {
+		t.Fatalf("got rep=%d addr=%s", rep, addr)
+	}
+}
+
+func TestReadReplyDomainSplit(t *testing.T) {
+	connection, server := pipeConnection(t)
+	reply := append([]byte{5, 0, 0, 3, 11}, "example.com"...)
+	reply = append(reply, 0, 80)
+	go func() {
+		for i := range reply {
+			if _, err := server.Write(reply[i : i+1]); err != nil {
+				return
+			}
+		}
+	}()
+
+	rep, host, port, err := connection.readReplyHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep != 0 || host != "example.com" || port != 80 {
+		t.Fatalf("got rep=%d host=%s port=%d", rep, host, port)
+	}
+}
+
+func TestReadReplyCoalesced(t *testing.T) {
+	connection, server := pipeConnection(t)
+	payload := []byte("HTTP/1.1 200 OK\r\n")
+	reply := []byte{5, 0, 0, 4, 0x20, 1, 0xd, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80}
+	go server.Write(append(reply, payload...))
+
+	rep, addr, err := connection.readReply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep != 0 || addr.String() != "[2001:db8::1]:80" {
+		t.Fatalf("got rep=%d addr=%s", rep, addr)
+	}
+
+	// the payload behind the reply must reach the reader of the connection
+	conn := &TCPConnection{
+		remoteAddr: addr,
+		localAddr:  addr,
+		forward:    connection.conn,
+		reader:     connection.reader,
+	}
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, payload) {
+		t.Fatalf("got payload %q", buf)
+	}
+}
+
+func TestReadReplyError(t *testing.T) {
+	connection, server := pipeConnection(t)
+	go server.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	rep, _, err := connection.readReply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep != 5 {
+		t.Fatalf("got rep=%d", rep)
+	}
+	if msg := (&ReplyError{Command: "connect", Code: rep}).Error(); msg != "proxy: connect failed: connection refused" {
+		t.Fatalf("got %q", msg)
+	}
+}
+
+func TestReadReplyTruncated(t *testing.T) {
+	connection, server := pipeConnection(t)
+	go func() {
+		server.Write([]byte{5, 0, 0, 1, 10, 0})
+		server.Close()
+	}()
+
+	if _, _, err := connection.readReply(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
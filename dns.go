@@ -0,0 +1,81 @@
+package go_socks5
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// Resolver returns a net.Resolver sending its DNS queries to server (host:port)
+// through the proxy instead of the system name servers. Queries go over a UDP
+// association, or over TCP through CONNECT once an association failed or
+// nothing ever came back through one.
+func (c *Client) Resolver(server string) *net.Resolver {
+	d := &dnsDialer{
+		client: c,
+		server: server,
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial:     d.dial,
+	}
+}
+
+type dnsDialer struct {
+	client *Client
+	server string
+	// tcp is set when UDP did not work, the following queries use TCP
+	tcp atomic.Bool
+	// answered is set once an answer came over UDP, later read errors are
+	// taken for lost datagrams rather than a relay that doesn't work
+	answered atomic.Bool
+}
+
+// dial ignores address, the name server of the system configuration.
+func (d *dnsDialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+		if d.tcp.Load() {
+			break
+		}
+		conn, err := d.client.dialUDP(ctx, "udp", d.server)
+		if err == nil {
+			return &dnsUDPConn{UDPConnection: conn, dialer: d}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		d.tcp.Store(true)
+	}
+	return d.client.DialContext(ctx, "tcp", d.server)
+}
+
+// dnsUDPConn moves the queries of its dialer to TCP when reading an answer fails,
+// as when the association was granted but the relay drops the datagrams. It
+// stays a net.PacketConn, the resolver frames its queries as for TCP otherwise.
+type dnsUDPConn struct {
+	*UDPConnection
+	dialer *dnsDialer
+}
+
+var _ net.PacketConn = (*dnsUDPConn)(nil)
+
+func (c *dnsUDPConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConnection.Read(b)
+	c.recordAnswer(err)
+	return n, err
+}
+
+func (c *dnsUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConnection.ReadFrom(b)
+	c.recordAnswer(err)
+	return n, addr, err
+}
+
+func (c *dnsUDPConn) recordAnswer(err error) {
+	if err == nil {
+		c.dialer.answered.Store(true)
+	} else if !c.dialer.answered.Load() {
+		c.dialer.tcp.Store(true)
+	}
+}
@@ -0,0 +1,96 @@
+package go_socks5
+
+import (
+	"context"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// answerA answers the A query in msg with 192.0.2.1, other queries without records.
+func answerA(msg []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	if q.Type == dnsmessage.TypeA {
+		b.AResource(dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   60,
+		}, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	}
+	return b.Finish()
+}
+
+// serveDNSRelay answers a UDP ASSOCIATE request with a relay answering the DNS
+// queries of its datagrams itself, the queries it can't parse are sent to bad.
+func serveDNSRelay(conn net.Conn, bad chan<- []byte) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	conn.Write(replyAddr(relay.LocalAddr().(*net.UDPAddr)))
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			// an IPv4 DST.ADDR, echoed as the source of the answer
+			if n < 10 || buf[3] != 1 {
+				continue
+			}
+			answer, err := answerA(buf[10:n])
+			if err != nil {
+				bad <- append([]byte(nil), buf[10:n]...)
+				continue
+			}
+			relay.WriteToUDP(append(append([]byte(nil), buf[:10]...), answer...), from)
+		}
+	}()
+	io.Copy(io.Discard, conn)
+}
+
+func TestResolverUDP(t *testing.T) {
+	bad := make(chan []byte, 10)
+	addr := listenSocks(t, func(conn net.Conn, cmd byte) {
+		if cmd == 3 {
+			serveDNSRelay(conn, bad)
+			return
+		}
+		// no TCP fallback
+		conn.Write([]byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0})
+	})
+	c := &Client{Addr: addr}
+	r := c.Resolver("192.0.2.53:53")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ips, err := r.LookupIP(ctx, "ip4", "example.com.")
+	select {
+	case query := <-bad:
+		t.Fatalf("relay got a query it can't parse: % x", query)
+	default:
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("got %v", ips)
+	}
+}
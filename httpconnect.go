@@ -0,0 +1,199 @@
+package go_socks5
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// maxAuthRounds bounds the 407 challenge/response exchanges of a CONNECT.
+const maxAuthRounds = 5
+
+// HTTPProxy dials TCP connections through an HTTP proxy with the CONNECT method,
+// it offers the same Dial and DialContext as Client.
+type HTTPProxy struct {
+	Addr     string
+	Username string
+	Password string
+	Debug    bool
+	// TLSConfig enables TLS on the connection to the proxy when set, the server
+	// name defaults to the host of Addr.
+	TLSConfig *tls.Config
+	// Header is sent along with every CONNECT request.
+	Header http.Header
+	// Authenticator answers the proxy authentication challenges, Basic
+	// authentication with Username and Password is used when nil.
+	Authenticator ProxyAuthenticator
+}
+
+// ProxyAuthenticator provides the Proxy-Authorization header of CONNECT requests,
+// connection based schemes such as NTLM or Negotiate run all of their rounds on
+// the same connection.
+type ProxyAuthenticator interface {
+	// Authorization returns the header value for the next CONNECT request, challenge
+	// is the 407 response to the previous one or nil for the first request.
+	// An empty value sends the request without the header.
+	Authorization(challenge *http.Response) (string, error)
+}
+
+type basicAuthenticator struct {
+	username string
+	password string
+}
+
+func (a basicAuthenticator) Authorization(challenge *http.Response) (string, error) {
+	if challenge != nil {
+		return "", errors.New("proxy: authentication failed")
+	}
+	auth := a.username + ":" + a.password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth)), nil
+}
+
+func (p *HTTPProxy) Dial(network, address string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address through the proxy, ctx bounds both the
+// connection to the proxy and the CONNECT exchange.
+func (p *HTTPProxy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		break
+	default:
+		return nil, errors.New("unsupported network: " + network)
+	}
+
+	remoteAddr, err := proxyAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.dialProxy(ctx)
+	if err != nil {
+		return nil, errors.New("can't connect to http proxy: " + err.Error())
+	}
+
+	stop := watchConn(ctx, conn)
+	reader := bufio.NewReader(conn)
+	resp, err := p.connect(conn, reader, address)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	return &HTTPConnection{
+		Conn:       conn,
+		reader:     reader,
+		remoteAddr: remoteAddr,
+		response:   resp,
+	}, nil
+}
+
+func (p *HTTPProxy) dialProxy(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if p.TLSConfig == nil {
+		return conn, nil
+	}
+
+	config := p.TLSConfig.Clone()
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(p.Addr); err == nil {
+			config.ServerName = host
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (p *HTTPProxy) connect(conn net.Conn, reader *bufio.Reader, address string) (*http.Response, error) {
+	auth := p.Authenticator
+	if auth == nil && (p.Username != "" || p.Password != "") {
+		auth = basicAuthenticator{username: p.Username, password: p.Password}
+	}
+
+	var challenge *http.Response
+	for round := 0; round < maxAuthRounds; round++ {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: address},
+			Host:   address,
+			Header: make(http.Header),
+		}
+		for k, v := range p.Header {
+			req.Header[k] = v
+		}
+		if auth != nil {
+			value, err := auth.Authorization(challenge)
+			if err != nil {
+				return nil, err
+			}
+			if value != "" {
+				req.Header.Set("Proxy-Authorization", value)
+			}
+		}
+		if err := req.Write(conn); err != nil {
+			return nil, err
+		}
+
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			return nil, err
+		}
+		if p.Debug {
+			log.Println("HTTPProxy CONNECT", address, resp.Status)
+		}
+		if resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+		// drain the body so the next request can be read from the same connection
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusProxyAuthRequired || auth == nil || resp.Close {
+			return nil, errors.New(fmt.Sprintf("proxy: connect failed: %s", resp.Status))
+		}
+		challenge = resp
+	}
+	return nil, errors.New("proxy: too many authentication rounds")
+}
+
+// HTTPConnection is a connection established through an HTTP proxy.
+type HTTPConnection struct {
+	net.Conn
+	// reader holds anything the proxy sent right behind its response
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	response   *http.Response
+}
+
+// Response returns the response of the proxy to the CONNECT request, its body is empty.
+func (c *HTTPConnection) Response() *http.Response {
+	return c.response
+}
+
+func (c *HTTPConnection) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *HTTPConnection) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
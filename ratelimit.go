@@ -0,0 +1,171 @@
+package go_socks5
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/time/rate"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// shaper delays relayed data to keep a connection within the rate limits of its client.
+// Waits end early when the connection is closed or its deadline passes.
+type shaper struct {
+	read  []*rate.Limiter
+	write []*rate.Limiter
+
+	readDeadline  waitDeadline
+	writeDeadline waitDeadline
+	closed        chan struct{}
+	once          sync.Once
+}
+
+// waitDeadline is the deadline of the waits in one direction, changing it
+// interrupts the waits in progress so they go on with the new one.
+type waitDeadline struct {
+	mu      sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+func (d *waitDeadline) get() (time.Time, chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	return d.t, d.changed
+}
+
+func (d *waitDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+		d.changed = nil
+	}
+}
+
+// newShaper returns the shaper of a new connection, nil when the client has no limits.
+func (c *Client) newShaper() *shaper {
+	s := &shaper{}
+	if c.ReadLimiter != nil {
+		s.read = append(s.read, c.ReadLimiter)
+	}
+	if c.WriteLimiter != nil {
+		s.write = append(s.write, c.WriteLimiter)
+	}
+	if c.ConnRateLimit > 0 {
+		// a burst of one second worth of data
+		s.read = append(s.read, rate.NewLimiter(rate.Limit(c.ConnRateLimit), c.ConnRateLimit))
+		s.write = append(s.write, rate.NewLimiter(rate.Limit(c.ConnRateLimit), c.ConnRateLimit))
+	}
+	if len(s.read) == 0 && len(s.write) == 0 {
+		return nil
+	}
+	s.closed = make(chan struct{})
+	return s
+}
+
+func (s *shaper) waitRead(n int) error {
+	if s == nil {
+		return nil
+	}
+	return s.waitBytes(s.read, n, &s.readDeadline)
+}
+
+func (s *shaper) waitWrite(n int) error {
+	if s == nil {
+		return nil
+	}
+	return s.waitBytes(s.write, n, &s.writeDeadline)
+}
+
+func (s *shaper) setReadDeadline(t time.Time) {
+	if s != nil {
+		s.readDeadline.set(t)
+	}
+}
+
+func (s *shaper) setWriteDeadline(t time.Time) {
+	if s != nil {
+		s.writeDeadline.set(t)
+	}
+}
+
+// close ends the waits in progress and makes later ones fail.
+func (s *shaper) close() {
+	if s != nil {
+		s.once.Do(func() {
+			close(s.closed)
+		})
+	}
+}
+
+// waitBytes takes n tokens from every limiter, in chunks no larger than their burst.
+func (s *shaper) waitBytes(limiters []*rate.Limiter, n int, deadline *waitDeadline) error {
+	for _, l := range limiters {
+		if l.Limit() == rate.Inf {
+			continue
+		}
+		burst := l.Burst()
+		if burst <= 0 {
+			return errors.New("rate limiter with no burst")
+		}
+		for left := n; left > 0; {
+			chunk := left
+			if chunk > burst {
+				chunk = burst
+			}
+			if err := s.waitN(l, chunk, deadline); err != nil {
+				return err
+			}
+			left -= chunk
+		}
+	}
+	return nil
+}
+
+func (s *shaper) waitN(l *rate.Limiter, n int, deadline *waitDeadline) error {
+	for {
+		t, changed := deadline.get()
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if t.IsZero() {
+			ctx, cancel = context.WithCancel(context.Background())
+		} else {
+			ctx, cancel = context.WithDeadline(context.Background(), t)
+		}
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-s.closed:
+			case <-changed:
+			case <-stop:
+			}
+			cancel()
+		}()
+		err := l.WaitN(ctx, n)
+		close(stop)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-s.closed:
+			return net.ErrClosed
+		case <-changed:
+			continue
+		default:
+		}
+		if !t.IsZero() {
+			// the deadline passed, or would before the tokens are available
+			return os.ErrDeadlineExceeded
+		}
+		return err
+	}
+}
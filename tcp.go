@@ -1,19 +1,32 @@
 package go_socks5
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
-	"fmt"
+	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
 type TCPListener struct {
+	client *Client
+	laddr  *net.TCPAddr
+	debug  bool
+	// ctx is cancelled by Close to interrupt a BIND in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+	// acceptMu serializes Accept and Bind, one BIND is pending at a time
+	acceptMu sync.Mutex
+
+	mu sync.Mutex
+	// controlconn is the connection of the pending BIND, nil once handed off
+	// to the caller of Accept until the next BIND
+	controlconn    *Connection
 	remoteBindAddr net.Addr
-	controlconn    net.Conn
-	localListener  net.Listener
-	debug          bool
+	err            error
+	closed         bool
 }
 
 type TCPConnection struct {
@@ -21,61 +34,168 @@ type TCPConnection struct {
 	remoteAddr net.Addr
 	localAddr  net.Addr
 	forward    net.Conn
+	// reader is where data is read from, it holds any bytes the proxy sent
+	// right behind its reply before reading from forward
+	reader io.Reader
+	shaper *shaper
 }
 
-func (c *TCPListener) Accept() (net.Conn, error) {
-	buf := make([]byte, 10)
-	n, err := c.controlconn.Read(buf)
+// bind issues a BIND request on a new connection to the proxy, for the next Accept.
+func (c *TCPListener) bind() error {
+	connection, err := c.client.connect(c.ctx)
 	if err != nil {
+		return err
+	}
+	stop := connection.watch(c.ctx)
+	bindAddr, err := connection.bind(c.laddr)
+	stop()
+	if err != nil {
+		connection.close()
+		return err
+	}
+	if bindAddr.IP == nil || bindAddr.IP.IsUnspecified() {
+		// listening on every address of the proxy host
+		if tcpAddr, ok := connection.conn.RemoteAddr().(*net.TCPAddr); ok {
+			bindAddr.IP = tcpAddr.IP
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		connection.close()
+		return net.ErrClosed
+	}
+	c.controlconn = connection
+	c.remoteBindAddr = bindAddr
+	return nil
+}
+
+// Bind issues the BIND request of the next Accept unless one is pending, Addr then
+// returns the address the proxy listens on. Accept binds again by itself after a
+// connection was accepted, Bind lets callers learn the new address beforehand.
+func (c *TCPListener) Bind() error {
+	c.acceptMu.Lock()
+	defer c.acceptMu.Unlock()
+	return c.bindPending()
+}
+
+func (c *TCPListener) bindPending() error {
+	c.mu.Lock()
+	pending, err := c.controlconn != nil, c.err
+	c.mu.Unlock()
+	if err != nil || pending {
+		return err
+	}
+
+	if err := c.bind(); err != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.closed {
+			err = net.ErrClosed
+		}
+		c.err = err
+		return err
+	}
+	return nil
+}
+
+func (c *TCPListener) Accept() (net.Conn, error) {
+	c.acceptMu.Lock()
+	defer c.acceptMu.Unlock()
+	if err := c.bindPending(); err != nil {
 		return nil, err
 	}
-	if n != 10 {
-		return nil, errors.New(fmt.Sprintf("expected packet of size 10 got %v", n))
+	c.mu.Lock()
+	if c.closed || c.controlconn == nil {
+		// closed since the BIND was issued
+		c.mu.Unlock()
+		return nil, net.ErrClosed
 	}
+	connection, bindAddr := c.controlconn, c.remoteBindAddr
+	c.mu.Unlock()
+
 	// set remote address to the one returned by the proxy
-	remoteAddr := &net.TCPAddr{
-		IP:   buf[4:8],
-		Port: int(binary.BigEndian.Uint16(buf[8:10])),
+	rep, remoteAddr, err := connection.readReply()
+	if err == nil && rep != 0 {
+		err = &ReplyError{Command: "bind", Code: rep}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the connection is the caller's from now on, the next Accept binds again
+	c.controlconn = nil
+	if c.closed {
+		err = net.ErrClosed
 	}
-	f, err := c.localListener.Accept()
 	if err != nil {
+		connection.close()
+		c.err = err
 		return nil, err
 	}
 	if c.debug {
-		log.Println("TCPListener on", c.Addr().String(), "accepted connection from", remoteAddr.String())
+		log.Println("TCPListener on", bindAddr.String(), "accepted connection from", remoteAddr.String())
 	}
 	return &TCPConnection{
 		debug:      c.debug,
 		remoteAddr: remoteAddr,
-		localAddr:  c.remoteBindAddr,
-		forward:    f,
+		localAddr:  bindAddr,
+		forward:    connection.conn,
+		reader:     connection.reader,
+		shaper:     c.client.newShaper(),
 	}, nil
 }
 
+// Addr returns the address the proxy listens on, that of the last BIND request.
 func (c *TCPListener) Addr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.remoteBindAddr
 }
 
+// Close closes the pending BIND, connections already accepted stay open.
 func (c *TCPListener) Close() error {
-	return c.controlconn.Close()
+	c.cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.controlconn == nil {
+		return nil
+	}
+	err := c.controlconn.close()
+	c.controlconn = nil
+	return err
 }
 
 func (c *TCPConnection) Close() error {
-	return nil
+	c.shaper.close()
+	return c.forward.Close()
+}
+
+// CloseWrite shuts down the writing side of the connection when the connection
+// to the proxy supports it, as *net.TCPConn and *tls.Conn do.
+func (c *TCPConnection) CloseWrite() error {
+	if cw, ok := c.forward.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("close write not supported")
 }
 
 func (c *TCPConnection) Read(b []byte) (int, error) {
-	if n, err := c.forward.Read(b); err != nil {
-		return n, nil
+	if n, err := c.reader.Read(b); err != nil {
+		return n, err
 	} else {
 		if c.debug {
 			log.Println("SR", "R="+c.remoteAddr.String(), "L="+c.localAddr.String(), n, b[:n])
 		}
-		return n, nil
+		return n, c.shaper.waitRead(n)
 	}
 }
 
 func (c *TCPConnection) Write(b []byte) (int, error) {
+	if err := c.shaper.waitWrite(len(b)); err != nil {
+		return 0, err
+	}
 	if n, err := c.forward.Write(b); err != nil {
 		return 0, err
 	} else {
@@ -95,13 +215,17 @@ func (c *TCPConnection) RemoteAddr() net.Addr {
 }
 
 func (c *TCPConnection) SetDeadline(t time.Time) error {
+	c.shaper.setReadDeadline(t)
+	c.shaper.setWriteDeadline(t)
 	return c.forward.SetDeadline(t)
 }
 
 func (c *TCPConnection) SetReadDeadline(t time.Time) error {
+	c.shaper.setReadDeadline(t)
 	return c.forward.SetReadDeadline(t)
 }
 
 func (c *TCPConnection) SetWriteDeadline(t time.Time) error {
+	c.shaper.setWriteDeadline(t)
 	return c.forward.SetWriteDeadline(t)
 }
@@ -0,0 +1,226 @@
+package go_socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bindServer answers BIND requests with 127.0.0.1 and ports counting from 1000,
+// the second reply of a request waits for a value on peers: the port of the
+// peer to report, or 0 to refuse the connection. Accepted connections echo.
+type bindServer struct {
+	addr  string
+	binds atomic.Int32
+	peers chan int
+}
+
+func listenBind(t *testing.T) *bindServer {
+	s := &bindServer{peers: make(chan int)}
+	s.addr = listenSocks(t, func(conn net.Conn, cmd byte) {
+		if cmd != 2 {
+			conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		port := 1000 + int(s.binds.Add(1))
+		conn.Write(binary.BigEndian.AppendUint16([]byte{5, 0, 0, 1, 127, 0, 0, 1}, uint16(port)))
+
+		// the client closing the BIND ends it before any peer
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, conn)
+			close(closed)
+		}()
+		select {
+		case peer := <-s.peers:
+			if peer == 0 {
+				conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			// the second reply and the first data in one write
+			reply := binary.BigEndian.AppendUint16([]byte{5, 0, 0, 1, 192, 0, 2, 1}, uint16(peer))
+			conn.Write(append(reply, "welcome"...))
+		case <-closed:
+			return
+		}
+		<-closed
+	})
+	return s
+}
+
+// accept waits for Accept in the background, so the test can make a peer connect.
+func accept(l net.Listener) <-chan net.Conn {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	return accepted
+}
+
+func TestTCPListenerAccept(t *testing.T) {
+	s := listenBind(t)
+	c := &Client{Addr: s.addr}
+	l, err := c.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Addr().String() != "127.0.0.1:1001" {
+		t.Fatalf("got address %s", l.Addr())
+	}
+
+	accepted := accept(l)
+	s.peers <- 4000
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accept failed")
+	}
+	defer conn.Close()
+	if conn.LocalAddr().String() != "127.0.0.1:1001" || conn.RemoteAddr().String() != "192.0.2.1:4000" {
+		t.Fatalf("got local %s remote %s", conn.LocalAddr(), conn.RemoteAddr())
+	}
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "welcome" {
+		t.Fatalf("got %q", buf)
+	}
+
+	// the accepted connection is the caller's, closing the listener leaves it open
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.binds.Load(); n != 1 {
+		t.Fatalf("%d BIND requests, want 1", n)
+	}
+}
+
+func TestTCPListenerBindAgain(t *testing.T) {
+	s := listenBind(t)
+	c := &Client{Addr: s.addr}
+	l, err := c.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := accept(l)
+	s.peers <- 4000
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accept failed")
+	}
+	defer conn.Close()
+
+	// the next BIND waits for Bind or Accept
+	if n := s.binds.Load(); n != 1 {
+		t.Fatalf("%d BIND requests after Accept, want 1", n)
+	}
+	tl := l.(*TCPListener)
+	if err := tl.Bind(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Bind(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.binds.Load(); n != 2 {
+		t.Fatalf("%d BIND requests after Bind, want 2", n)
+	}
+	if l.Addr().String() != "127.0.0.1:1002" {
+		t.Fatalf("got address %s", l.Addr())
+	}
+
+	accepted = accept(l)
+	s.peers <- 4001
+	conn = <-accepted
+	if conn == nil {
+		t.Fatal("accept failed")
+	}
+	defer conn.Close()
+	if conn.LocalAddr().String() != "127.0.0.1:1002" || conn.RemoteAddr().String() != "192.0.2.1:4001" {
+		t.Fatalf("got local %s remote %s", conn.LocalAddr(), conn.RemoteAddr())
+	}
+	if n := s.binds.Load(); n != 2 {
+		t.Fatalf("%d BIND requests, want 2", n)
+	}
+}
+
+func TestTCPListenerRefused(t *testing.T) {
+	s := listenBind(t)
+	c := &Client{Addr: s.addr}
+	l, err := c.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := accept(l)
+	s.peers <- 0
+	if conn := <-accepted; conn != nil {
+		t.Fatal("accepted a refused connection")
+	}
+
+	var replyErr *ReplyError
+	if _, err := l.Accept(); !errors.As(err, &replyErr) || replyErr.Code != 5 {
+		t.Fatalf("got %v, want the refusal again", err)
+	}
+}
+
+func TestTCPListenerClose(t *testing.T) {
+	s := listenBind(t)
+	c := &Client{Addr: s.addr}
+	l, err := c.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != net.ErrClosed {
+			t.Fatalf("got %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept not interrupted by Close")
+	}
+	if _, err := l.Accept(); err != net.ErrClosed {
+		t.Fatalf("got %v, want %v", err, net.ErrClosed)
+	}
+	if err := l.(*TCPListener).Bind(); err != net.ErrClosed {
+		t.Fatalf("got %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestTCPListenerCloseRace(t *testing.T) {
+	s := listenBind(t)
+	c := &Client{Addr: s.addr}
+	for i := 0; i < 100; i++ {
+		l, err := c.Listen("tcp", "0.0.0.0:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go l.Close()
+		if _, err := l.Accept(); err != net.ErrClosed {
+			t.Fatalf("got %v, want %v", err, net.ErrClosed)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package go_socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+func (c *Client) dialProxy(ctx context.Context) (net.Conn, error) {
+	if c.WebSocketURL != "" {
+		return c.dialWebSocket(ctx)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.TLSConfig == nil && len(c.TLSPinnedKeys) == 0 {
+		return conn, nil
+	}
+
+	host, _, _ := net.SplitHostPort(c.Addr)
+	tlsConn := tls.Client(conn, c.tlsConfig(host))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// tlsConfig returns the TLS configuration of the connection to the proxy,
+// serverName is used when TLSConfig doesn't set one.
+func (c *Client) tlsConfig(serverName string) *tls.Config {
+	config := c.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = serverName
+	}
+	if len(c.TLSPinnedKeys) == 0 {
+		return config
+	}
+
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		// the peer can send any certificates, only those of a verified chain or,
+		// when verification is skipped, the leaf that proved possession of its
+		// key can match a pin
+		if len(cs.VerifiedChains) == 0 {
+			if len(cs.PeerCertificates) > 0 && c.pinned(cs.PeerCertificates[0]) {
+				return nil
+			}
+			return errors.New("proxy: certificate key is not pinned")
+		}
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				if c.pinned(cert) {
+					return nil
+				}
+			}
+		}
+		return errors.New("proxy: no pinned key in certificate chain")
+	}
+	return config
+}
+
+func (c *Client) pinned(cert *x509.Certificate) bool {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range c.TLSPinnedKeys {
+		if bytes.Equal(pin, sum[:]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package go_socks5
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a certificate for 127.0.0.1 signed by its own key.
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// serve accepts connections on l and hands them to handle until l is closed.
+func serve(t *testing.T, l net.Listener, handle func(net.Conn)) string {
+	t.Cleanup(func() {
+		l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTLSPinned(t *testing.T) {
+	cert := selfSigned(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, l, serveEcho)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	pin := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	c := &Client{
+		Addr:          addr,
+		TLSConfig:     &tls.Config{RootCAs: roots},
+		TLSPinnedKeys: [][]byte{pin[:]},
+	}
+	testEcho(t, c)
+
+	c.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	testEcho(t, c)
+
+	c.TLSPinnedKeys = [][]byte{make([]byte, sha256.Size)}
+	if conn, err := c.Dial("tcp", "example.com:80"); err == nil {
+		conn.Close()
+		t.Fatal("connected through a proxy with no pinned key")
+	}
+}
+
+func TestTLSPinnedWithoutConfig(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make(chan byte, 1)
+	addr := serve(t, l, func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 1)
+		if _, err := conn.Read(buf); err == nil {
+			first <- buf[0]
+		}
+	})
+
+	pin := sha256.Sum256([]byte("key"))
+	c := &Client{
+		Addr:          addr,
+		TLSPinnedKeys: [][]byte{pin[:]},
+	}
+	if conn, err := c.Dial("tcp", "example.com:80"); err == nil {
+		conn.Close()
+		t.Fatal("connected to a proxy without TLS")
+	}
+	// a TLS handshake record rather than a SOCKS greeting
+	if b := <-first; b != 0x16 {
+		t.Fatalf("proxy received %#x first, want a TLS handshake", b)
+	}
+}
@@ -0,0 +1,74 @@
+package go_socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Tor extensions to SOCKS5 commands
+const (
+	cmdResolve    = 0xf0
+	cmdResolvePTR = 0xf1
+)
+
+// WithAuth returns a copy of the client using username and password. Tor
+// isolates streams opened with different credentials on separate circuits.
+func (c *Client) WithAuth(username, password string) *Client {
+	clone := *c
+	clone.Username = username
+	clone.Password = password
+	return &clone
+}
+
+// LookupHost resolves host through the proxy with the Tor RESOLVE command.
+// Tor answers with a single address.
+func (c *Client) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	addr, err := c.resolve(ctx, cmdResolve, "resolve", host)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(addr) == nil {
+		return nil, errors.New("proxy: resolve returned a hostname: " + addr)
+	}
+	return []string{addr}, nil
+}
+
+// LookupAddr reverse resolves addr through the proxy with the Tor RESOLVE_PTR command.
+func (c *Client) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if net.ParseIP(addr) == nil {
+		return nil, errors.New("proxy: not an ip address: " + addr)
+	}
+	name, err := c.resolve(ctx, cmdResolvePTR, "resolve_ptr", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []string{name}, nil
+}
+
+func (c *Client) resolve(ctx context.Context, cmd byte, name, host string) (string, error) {
+	connection, err := c.connect(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer connection.close()
+
+	stop := connection.watch(ctx)
+	defer stop()
+	if err := connection.request(cmd, host, 0); err != nil {
+		return "", err
+	}
+	rep, addr, _, err := connection.readReplyHost()
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	} else if rep != 0 {
+		return "", &ReplyError{Command: name, Code: rep}
+	}
+	return addr, nil
+}
@@ -1,27 +1,63 @@
 package go_socks5
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
 //TODO packet size / fragmentation
 
+// UDPMode selects how datagrams are exchanged with the proxy.
+type UDPMode int
+
+const (
+	// UDPRelay sends datagrams to the relay port returned by UDP ASSOCIATE.
+	UDPRelay UDPMode = iota
+	// UDPOverTCP carries length-prefixed datagrams in the TCP connection to the proxy.
+	UDPOverTCP
+	// UDPAuto uses UDPRelay and falls back to UDPOverTCP when the association is
+	// refused or nothing comes back from the relay after the first write.
+	UDPAuto
+)
+
+// DefaultUDPFallbackTimeout is how long UDPAuto waits for a datagram from the
+// relay when Client.UDPFallbackTimeout is not set.
+const DefaultUDPFallbackTimeout = 5 * time.Second
+
+// fallbackDialTimeout bounds the connection to the proxy of a UDPAuto fallback.
+const fallbackDialTimeout = 30 * time.Second
+
 type UDPConnection struct {
+	client      *Client
+	laddr       *net.UDPAddr
 	controlconn *Connection
-	forward     net.Conn
+	forward     datagramConn
 	debug       bool
-	remoteAddr  *net.UDPAddr
+	remoteAddr  net.Addr
+	shaper      *shaper
+
+	mu            sync.Mutex
+	fallback      bool
+	received      bool
+	closed        bool
+	timer         *time.Timer
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// cancelFallback interrupts a fallback in progress when the connection is closed
+	cancelFallback context.CancelFunc
 }
 
 func (u *UDPConnection) Read(b []byte) (int, error) {
 	if n, addr, err := u.ReadFrom(b); err != nil {
-		return n, nil
-	} else if addr.String() != u.remoteAddr.String() {
+		return n, err
+	} else if u.remoteAddr != nil && addr.String() != u.remoteAddr.String() {
 		//TODO handle wrong addr
 		return n, nil
 	} else {
@@ -35,29 +71,61 @@ func (u *UDPConnection) ReadFrom(b []byte) (int, net.Addr, error) {
 	}
 
 	buf := make([]byte, len(b)+MaxProtoSize)
-	rc, err := u.forward.Read(buf)
-	if err != nil {
+	var rc int
+	for {
+		forward := u.getForward()
+		var err error
+		rc, err = forward.readDatagram(buf)
+		if err == nil {
+			break
+		}
+		if forward != u.getForward() {
+			// switched over to the tunnel while reading
+			continue
+		}
 		return 0, nil, err
 	}
-	//TODO support ipv6 and domain
-	var from_addr *net.UDPAddr
-	var n int
+	u.mu.Lock()
+	u.received = true
+	u.mu.Unlock()
+
+	var from_addr net.Addr
+	var hdrLen int
+	if rc < 5 {
+		return 0, nil, errors.New(fmt.Sprintf("short datagram: %d", rc))
+	}
 	switch buf[3] {
 	case 1: // IPv4
-		n = rc - 10
-		from_addr = &net.UDPAddr{
-			IP:   buf[4:8],
-			Port: int(binary.BigEndian.Uint16(buf[8:])),
-		}
-		copy(b, buf[10:rc])
-		break
+		hdrLen = 10
+	case 3: // domain
+		hdrLen = 7 + int(buf[4])
+	case 4: // IPv6
+		hdrLen = 22
 	default:
 		return 0, nil, errors.New(fmt.Sprintf("unsupported atyp: %d", buf[3]))
 	}
+	if rc < hdrLen {
+		return 0, nil, errors.New(fmt.Sprintf("short datagram: %d", rc))
+	}
+	port := int(binary.BigEndian.Uint16(buf[hdrLen-2:]))
+	if buf[3] == 3 {
+		from_addr = &domainAddr{
+			network: "udp",
+			address: net.JoinHostPort(string(buf[5:hdrLen-2]), strconv.Itoa(port)),
+		}
+	} else {
+		ip := make(net.IP, hdrLen-6)
+		copy(ip, buf[4:hdrLen-2])
+		from_addr = &net.UDPAddr{
+			IP:   ip,
+			Port: port,
+		}
+	}
+	n := copy(b, buf[hdrLen:rc])
 	if u.debug {
 		log.Println("UDPConnection readFrom", from_addr, n, b[:n])
 	}
-	return n, from_addr, nil
+	return n, from_addr, u.shaper.waitRead(n)
 }
 
 func (u *UDPConnection) Write(b []byte) (int, error) {
@@ -65,51 +133,141 @@ func (u *UDPConnection) Write(b []byte) (int, error) {
 }
 
 func (u *UDPConnection) WriteTo(b []byte, addr net.Addr) (int, error) {
-	var ip []byte
-	var ipLen int
+	var atyp byte
+	var host []byte
 	var port int
-	switch addr.(type) {
+	switch addr := addr.(type) {
 	case *net.UDPAddr:
-		udpAddr := addr.(*net.UDPAddr)
-		ipLen = 4
-		ip = udpAddr.IP.To4()
-		port = udpAddr.Port
-		break
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			atyp = 1
+			host = ip4
+		} else if ip6 := addr.IP.To16(); ip6 != nil {
+			atyp = 4
+			host = ip6
+		} else {
+			return 0, errors.New(fmt.Sprintf("unsupported ip length: %d", len(addr.IP)))
+		}
+		port = addr.Port
+	case *domainAddr:
+		name, portStr, err := net.SplitHostPort(addr.address)
+		if err != nil {
+			return 0, err
+		}
+		if port, err = strconv.Atoi(portStr); err != nil {
+			return 0, err
+		}
+		if len(name) > 255 {
+			return 0, errors.New("hostname too long: " + name)
+		}
+		atyp = 3
+		host = append([]byte{byte(len(name))}, name...)
 	default:
 		return 0, errors.New("unsupported address type")
 	}
 
-	buf := make([]byte, len(b)+6+ipLen)
+	buf := make([]byte, len(b)+6+len(host))
 	buf[0] = 0
 	buf[1] = 0
 	buf[2] = 0
-	if ipLen == 4 {
-		buf[3] = 1
-	} else {
-		return 0, errors.New(fmt.Sprintf("unsupported ip length: %d", ipLen))
-	}
-	copy(buf[4:], ip)
-	binary.BigEndian.PutUint16(buf[8:], uint16(port))
-	copy(buf[10:], b)
+	buf[3] = atyp
+	copy(buf[4:], host)
+	binary.BigEndian.PutUint16(buf[4+len(host):], uint16(port))
+	copy(buf[6+len(host):], b)
 
-	if rc, err := u.forward.Write(buf); err != nil {
+	if err := u.shaper.waitWrite(len(b)); err != nil {
 		return 0, err
-	} else {
-		n := rc - 10
+	}
+	if err := u.getForward().writeDatagram(buf); err != nil {
+		return 0, err
+	}
+	u.startFallbackTimer()
+	if u.debug {
+		log.Println("UDPConnection writeTo", addr.String(), len(b), b)
+	}
+	return len(b), nil
+}
+
+func (u *UDPConnection) getForward() datagramConn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.forward
+}
+
+func (u *UDPConnection) startFallbackTimer() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.fallback || u.received || u.timer != nil {
+		return
+	}
+	timeout := u.client.UDPFallbackTimeout
+	if timeout == 0 {
+		timeout = DefaultUDPFallbackTimeout
+	}
+	u.timer = time.AfterFunc(timeout, u.fallBack)
+}
+
+// fallBack moves the association over to a UDP tunnel when nothing was received
+// from the relay, the relay socket is closed to wake up pending reads.
+func (u *UDPConnection) fallBack() {
+	u.mu.Lock()
+	if !u.fallback || u.received {
+		u.mu.Unlock()
+		return
+	}
+	u.fallback = false
+	ctx, cancel := context.WithTimeout(context.Background(), fallbackDialTimeout)
+	defer cancel()
+	u.cancelFallback = cancel
+	u.mu.Unlock()
+
+	// the tunnel is set up without holding the lock so the connection stays usable
+	connection, forward, err := u.client.udpTunnel(ctx, u.laddr)
+	if err != nil {
 		if u.debug {
-			log.Println("UDPConnection writeTo", addr.String(), n, b[:n])
+			log.Println("UDPConnection can't fall back to udp tunnel:", err)
 		}
-		return n, nil
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed || u.received {
+		// closed, or the relay answered, while the tunnel was set up
+		connection.close()
+		return
 	}
+	if u.debug {
+		log.Println("UDPConnection falling back to udp tunnel")
+	}
+	forward.SetReadDeadline(u.readDeadline)
+	forward.SetWriteDeadline(u.writeDeadline)
+	u.controlconn.close()
+	u.forward.Close()
+	u.controlconn = connection
+	u.forward = forward
 }
 
 func (u *UDPConnection) Close() error {
-	u.controlconn.close()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fallback = false
+	u.closed = true
+	if u.timer != nil {
+		u.timer.Stop()
+	}
+	if u.cancelFallback != nil {
+		u.cancelFallback()
+	}
+	u.shaper.close()
+	if isRelay(u.forward) {
+		// a tunnel is the control connection itself, closed just below
+		u.controlconn.close()
+	}
 	return u.forward.Close()
 }
 
 func (u *UDPConnection) LocalAddr() net.Addr {
-	return u.forward.LocalAddr()
+	return u.getForward().LocalAddr()
 }
 
 func (u *UDPConnection) RemoteAddr() net.Addr {
@@ -117,13 +275,155 @@ func (u *UDPConnection) RemoteAddr() net.Addr {
 }
 
 func (u *UDPConnection) SetDeadline(t time.Time) error {
-	return u.forward.SetDeadline(t)
+	if err := u.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return u.SetWriteDeadline(t)
 }
 
 func (u *UDPConnection) SetReadDeadline(t time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.readDeadline = t
+	u.shaper.setReadDeadline(t)
 	return u.forward.SetReadDeadline(t)
 }
 
 func (u *UDPConnection) SetWriteDeadline(t time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.writeDeadline = t
+	u.shaper.setWriteDeadline(t)
 	return u.forward.SetWriteDeadline(t)
 }
+
+// datagramConn carries SOCKS UDP datagrams, header included, to and from the proxy.
+type datagramConn interface {
+	readDatagram(buf []byte) (int, error)
+	writeDatagram(buf []byte) error
+	Close() error
+	LocalAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// relayConn exchanges datagrams with the UDP relay of the proxy.
+type relayConn struct {
+	net.Conn
+}
+
+func isRelay(forward datagramConn) bool {
+	_, ok := forward.(relayConn)
+	return ok
+}
+
+func (r relayConn) readDatagram(buf []byte) (int, error) {
+	return r.Read(buf)
+}
+
+func (r relayConn) writeDatagram(buf []byte) error {
+	_, err := r.Write(buf)
+	return err
+}
+
+// tunnelConn carries datagrams in the control connection, the RSV field of each
+// header holding the length of the data following it.
+type tunnelConn struct {
+	*Connection
+	mu sync.Mutex
+	// frame holds a datagram partly read when a read failed, on a deadline for
+	// instance, the next read completes it so the stream stays in sync
+	frame []byte
+}
+
+func (t *tunnelConn) readDatagram(buf []byte) (int, error) {
+	for {
+		size, err := tunnelFrameSize(t.frame)
+		if err != nil {
+			return 0, err
+		}
+		if len(t.frame) == size {
+			break
+		}
+		if cap(t.frame) < size {
+			frame := make([]byte, len(t.frame), size)
+			copy(frame, t.frame)
+			t.frame = frame
+		}
+		n, err := t.reader.Read(t.frame[len(t.frame):size])
+		t.frame = t.frame[:len(t.frame)+n]
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	t.frame[0] = 0
+	t.frame[1] = 0
+	// truncated like a UDP read into a short buffer
+	n := copy(buf, t.frame)
+	t.frame = t.frame[:0]
+	return n, nil
+}
+
+// tunnelFrameSize returns the size of the frame starting with p, or how much of
+// it must be read to know its size.
+func tunnelFrameSize(p []byte) (int, error) {
+	// RSV, FRAG, ATYP and the first byte of DST.ADDR
+	if len(p) < 5 {
+		return 5, nil
+	}
+	var hdrLen int
+	switch p[3] {
+	case 1: // IPv4
+		hdrLen = 10
+	case 3: // domain
+		hdrLen = 7 + int(p[4])
+	case 4: // IPv6
+		hdrLen = 22
+	default:
+		return 0, errors.New(fmt.Sprintf("unsupported atyp: %d", p[3]))
+	}
+	if len(p) < hdrLen {
+		return hdrLen, nil
+	}
+	return hdrLen + int(binary.BigEndian.Uint16(p[0:2])), nil
+}
+
+func (t *tunnelConn) writeDatagram(buf []byte) error {
+	var hdrLen int
+	switch buf[3] {
+	case 1: // IPv4
+		hdrLen = 10
+	case 3: // domain
+		hdrLen = 7 + int(buf[4])
+	case 4: // IPv6
+		hdrLen = 22
+	default:
+		return errors.New(fmt.Sprintf("unsupported atyp: %d", buf[3]))
+	}
+	if len(buf)-hdrLen > 0xffff {
+		return errors.New(fmt.Sprintf("datagram too large: %d", len(buf)-hdrLen))
+	}
+	binary.BigEndian.PutUint16(buf[0:2], uint16(len(buf)-hdrLen))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := t.conn.Write(buf)
+	return err
+}
+
+func (t *tunnelConn) Close() error {
+	return t.close()
+}
+
+func (t *tunnelConn) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+func (t *tunnelConn) SetReadDeadline(tm time.Time) error {
+	return t.conn.SetReadDeadline(tm)
+}
+
+func (t *tunnelConn) SetWriteDeadline(tm time.Time) error {
+	return t.conn.SetWriteDeadline(tm)
+}
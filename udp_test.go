@@ -0,0 +1,227 @@
+package go_socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// listenSocks serves clients without authentication on the loopback interface,
+// handle gets each connection once its request was read.
+func listenSocks(t *testing.T, handle func(conn net.Conn, cmd byte)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serve(t, l, func(conn net.Conn) {
+		defer conn.Close()
+		cmd, err := readRequest(conn)
+		if err != nil {
+			return
+		}
+		handle(conn, cmd)
+	})
+}
+
+// replyAddr is a successful reply carrying addr as BND.ADDR and BND.PORT.
+func replyAddr(addr *net.UDPAddr) []byte {
+	b := append([]byte{5, 0, 0, 1}, addr.IP.To4()...)
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
+
+// readFrame reads a datagram of a UDP tunnel, the RSV field of its header holding
+// the length of the data.
+func readFrame(r io.Reader) ([]byte, error) {
+	frame := make([]byte, 5, 22+0xffff)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	var hdrLen int
+	switch frame[3] {
+	case 1:
+		hdrLen = 10
+	case 3:
+		hdrLen = 7 + int(frame[4])
+	case 4:
+		hdrLen = 22
+	default:
+		return nil, errors.New("unsupported atyp")
+	}
+	frame = frame[:hdrLen+int(binary.BigEndian.Uint16(frame))]
+	if _, err := io.ReadFull(r, frame[5:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// serveTunnel answers a UDP tunnel request and echoes its datagrams.
+func serveTunnel(conn net.Conn) {
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	for {
+		frame, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+// testUDPEcho writes until a datagram comes back, UDPAuto drops those written
+// before it falls back.
+func testUDPEcho(t *testing.T, conn net.Conn) {
+	buf := make([]byte, 16)
+	for i := 0; i < 50; i++ {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "hello" {
+			t.Fatalf("got %q", buf[:n])
+		}
+		return
+	}
+	t.Fatal("no datagram came back")
+}
+
+func TestUDPTunnel(t *testing.T) {
+	addr := listenSocks(t, func(conn net.Conn, cmd byte) {
+		if cmd == 0xf3 {
+			serveTunnel(conn)
+		}
+	})
+	c := &Client{Addr: addr, UDPMode: UDPOverTCP}
+	conn, err := c.Dial("udp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := conn.(net.PacketConn)
+
+	to := &domainAddr{network: "udp", address: "example.com:53"}
+	if _, err := pc.WriteTo([]byte("query"), to); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "query" || from.String() != to.String() {
+		t.Fatalf("got %q from %s", buf[:n], from)
+	}
+	testUDPEcho(t, conn)
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPTunnelPartialFrame(t *testing.T) {
+	resume := make(chan struct{})
+	addr := listenSocks(t, func(conn net.Conn, cmd byte) {
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		frame := append([]byte{0, 5, 0, 1, 192, 0, 2, 1, 0, 53}, "hello"...)
+		conn.Write(frame[:7])
+		<-resume
+		conn.Write(frame[7:])
+		conn.Write(append([]byte{0, 5, 0, 1, 192, 0, 2, 1, 0, 53}, "world"...))
+		io.Copy(io.Discard, conn)
+	})
+	c := &Client{Addr: addr, UDPMode: UDPOverTCP}
+	conn, err := c.Dial("udp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	close(resume)
+
+	// the frame cut by the deadline is completed, not taken for a new one
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{"hello", "world"} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Fatalf("got %q, want %q", buf[:n], want)
+		}
+	}
+}
+
+func TestUDPAutoFallback(t *testing.T) {
+	tunnels := make(chan struct{}, 1)
+	addr := listenSocks(t, func(conn net.Conn, cmd byte) {
+		switch cmd {
+		case 3:
+			// a relay that drops every datagram
+			relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				return
+			}
+			defer relay.Close()
+			conn.Write(replyAddr(relay.LocalAddr().(*net.UDPAddr)))
+			io.Copy(io.Discard, conn)
+		case 0xf3:
+			tunnels <- struct{}{}
+			serveTunnel(conn)
+		}
+	})
+	c := &Client{Addr: addr, UDPMode: UDPAuto, UDPFallbackTimeout: 50 * time.Millisecond}
+	conn, err := c.Dial("udp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isRelay(conn.(*UDPConnection).getForward()) {
+		t.Fatal("association not used first")
+	}
+	testUDPEcho(t, conn)
+	select {
+	case <-tunnels:
+	default:
+		t.Fatal("no tunnel requested")
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPAutoRefused(t *testing.T) {
+	addr := listenSocks(t, func(conn net.Conn, cmd byte) {
+		switch cmd {
+		case 3:
+			conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		case 0xf3:
+			serveTunnel(conn)
+		}
+	})
+	c := &Client{Addr: addr, UDPMode: UDPAuto}
+	conn, err := c.Dial("udp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isRelay(conn.(*UDPConnection).getForward()) {
+		t.Fatal("refused association used")
+	}
+	testUDPEcho(t, conn)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
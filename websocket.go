@@ -0,0 +1,106 @@
+package go_socks5
+
+import (
+	"context"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+func (c *Client) dialWebSocket(ctx context.Context) (net.Conn, error) {
+	u, err := url.Parse(c.WebSocketURL)
+	if err != nil {
+		return nil, err
+	}
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		config.TlsConfig = c.tlsConfig(u.Hostname())
+	}
+
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// WebSocketListener is a net.Listener of SOCKS connections tunnelled in WebSockets,
+// it is served as the http.Handler of the path clients set in Client.WebSocketURL.
+type WebSocketListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewWebSocketListener returns a WebSocketListener reporting addr as its address.
+func NewWebSocketListener(addr net.Addr) *WebSocketListener {
+	return &WebSocketListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	websocket.Server{Handler: l.handle}.ServeHTTP(w, r)
+}
+
+func (l *WebSocketListener) handle(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &webSocketConn{
+		Conn:   ws,
+		closed: make(chan struct{}),
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		return
+	}
+	// the upgraded connection is closed when the handler returns
+	<-conn.closed
+}
+
+func (l *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *WebSocketListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *WebSocketListener) Addr() net.Addr {
+	return l.addr
+}
+
+type webSocketConn struct {
+	*websocket.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *webSocketConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return err
+}
@@ -0,0 +1,134 @@
+package go_socks5
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readRequest answers the greeting of a client without authentication and reads
+// its request, it returns the command.
+func readRequest(conn net.Conn) (byte, error) {
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return 0, err
+	}
+	conn.Write([]byte{5, 0})
+
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return 0, err
+	}
+	cmd := buf[1]
+	addrLen := 0
+	switch buf[3] {
+	case 1:
+		addrLen = net.IPv4len
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return 0, err
+		}
+		addrLen = int(buf[0])
+	case 4:
+		addrLen = net.IPv6len
+	}
+	if _, err := io.ReadFull(conn, buf[:addrLen+2]); err != nil {
+		return 0, err
+	}
+	return cmd, nil
+}
+
+// serveEcho answers a CONNECT request of a client without authentication, then
+// echoes everything back instead of connecting.
+func serveEcho(conn net.Conn) {
+	defer conn.Close()
+	if _, err := readRequest(conn); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0x04, 0x38})
+	io.Copy(conn, conn)
+}
+
+func serveWebSocket(t *testing.T, tlsServer bool) (*httptest.Server, string) {
+	l := NewWebSocketListener(&net.TCPAddr{})
+	var hs *httptest.Server
+	if tlsServer {
+		hs = httptest.NewTLSServer(l)
+	} else {
+		hs = httptest.NewServer(l)
+	}
+	t.Cleanup(func() {
+		l.Close()
+		hs.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveEcho(conn)
+		}
+	}()
+	return hs, "ws" + strings.TrimPrefix(hs.URL, "http") + "/"
+}
+
+func testEcho(t *testing.T, c *Client) {
+	conn, err := c.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("got %q", buf)
+	}
+}
+
+func TestWebSocketTunnel(t *testing.T) {
+	_, wsURL := serveWebSocket(t, false)
+	testEcho(t, &Client{WebSocketURL: wsURL})
+}
+
+func TestWebSocketTunnelTLSPinned(t *testing.T) {
+	hs, wsURL := serveWebSocket(t, true)
+	leaf, err := x509.ParseCertificate(hs.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	c := &Client{
+		WebSocketURL:  wsURL,
+		TLSConfig:     &tls.Config{RootCAs: hs.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs},
+		TLSPinnedKeys: [][]byte{pin[:]},
+	}
+	testEcho(t, c)
+
+	c.TLSPinnedKeys = [][]byte{make([]byte, sha256.Size)}
+	if conn, err := c.Dial("tcp", "example.com:80"); err == nil {
+		conn.Close()
+		t.Fatal("connected through a proxy with no pinned key")
+	}
+}
+
+func TestWebSocketListenerClose(t *testing.T) {
+	l := NewWebSocketListener(&net.TCPAddr{})
+	l.Close()
+	if _, err := l.Accept(); err != net.ErrClosed {
+		t.Fatalf("got %v, want %v", err, net.ErrClosed)
+	}
+}